@@ -2,7 +2,7 @@
 //
 //  BufferedLog.go
 //
-//  Copyright (c) 2014, Jared Chavez. 
+//  Copyright (c) 2014, Jared Chavez.
 //  All rights reserved.
 //
 //  Use of this source code is governed by a BSD-style
@@ -14,28 +14,68 @@ package flog
 
 import (
     "bytes"
-    "io"
+    "fmt"
     "log"
     "os"
+    "path"
+    "path/filepath"
+    "reflect"
+    "runtime"
+    "strings"
     "sync"
     "sync/atomic"
     "time"
+    "unsafe"
 )
 
+// pkgPath is this package's import path, used by callerLine to walk past
+// flog's own stack frames (which may vary in depth call to call once
+// inlining is taken into account) and find the real external caller.
+var pkgPath = reflect.TypeOf(BufferedLog{}).PkgPath()
+
+// bufferPool recycles the *bytes.Buffer values used to format log entries
+// across all BufferedLog instances, so that Print does not allocate a new
+// buffer on every call.
+var bufferPool = sync.Pool{
+    New: func() interface{} {
+        return new(bytes.Buffer)
+    },
+}
+
+// entryNode is a single node in a BufferedLog's lock-free queue of
+// formatted, not-yet-flushed log entries.
+type entryNode struct {
+    buf  *bytes.Buffer
+    next unsafe.Pointer // *entryNode
+}
+
+// nodePool recycles the *entryNode values pushed onto a BufferedLog's entry
+// queue, so that enqueue does not heap-allocate a fresh node on every Print.
+var nodePool = sync.Pool{
+    New: func() interface{} {
+        return new(entryNode)
+    },
+}
+
 // BufferedLog represents a buffered, file-backed logger and enforces a standardized
-// logging format. New logging entries are sent to a memory buffer and
-// periodically flushed to the backing file at configurable intervals 
-// by a seperate goroutine.
+// logging format. Print formats each entry into a pooled buffer and pushes it
+// onto a lock-free queue; a separate goroutine periodically drains that queue
+// and flushes the entries to the backing file.
 type BufferedLog struct {
-    baseDir  string
-    buffer   bytes.Buffer
-    chClose  chan interface{}
-    enabled  int32
-    file     *os.File
-    flushSec int32
-    lock     sync.RWMutex
-    logger   *log.Logger
-    name     string
+    baseDir         string
+    chClose         chan interface{}
+    enabled         int32
+    fileSink        *FileSink
+    flushSec        int32
+    format          FLogFormat
+    lock            sync.RWMutex
+    moduleVerbosity map[string]int32
+    name            string
+    queueHead       unsafe.Pointer // *entryNode
+    rotatedAt       time.Time
+    rotation        RotationPolicy
+    sinks           []Sink
+    verbosity       int32
 }
 
 // BaseDir returns the base directory of the file backing this BufferedLog instance.
@@ -46,25 +86,19 @@ func (this *BufferedLog) BaseDir() string {
     return this.baseDir
 }
 
-// Close disables the BufferedLog instance, flushes any remaining entries to disk, and
-// then closes the backing log file.
+// Close disables the BufferedLog instance, flushes any remaining entries to
+// disk, and then closes every configured sink.
 func (this *BufferedLog) Close() {
     this.lock.Lock()
     defer this.lock.Unlock()
 
-    this.enabled = 0
-
-    this.print("==== Close log ====")
-
-    // stop flush routine
-    this.chClose <- nil
-    <-this.chClose
+    this.stopAndFlush()
 
-    // flush logs
-    this.flushLogs()
+    for _, s := range this.sinks {
+        s.Close()
+    }
 
-    // close file
-    this.file.Close()
+    unregisterLogger(this)
 }
 
 // Disable temporarily disables the BufferedLog instance. New calls to Print will have no
@@ -78,12 +112,62 @@ func (this *BufferedLog) Enable() {
     atomic.StoreInt32(&this.enabled, 1)
 }
 
+// Error formats and buffers an Error-level log entry, with a stack dump of
+// the calling goroutine appended to the formatted line.
+func (this *BufferedLog) Error(format string, v ...interface{}) {
+    this.printLevel(LevelError, nil, format, v...)
+}
+
+// ExtraSinks returns the Sinks configured on this BufferedLog instance via
+// WithSinks, beyond the primary FileSink. Rotate uses this to carry them
+// over to the replacement FLog instance untouched.
+func (this *BufferedLog) ExtraSinks() []Sink {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    if len(this.sinks) <= 1 {
+        return nil
+    }
+
+    return this.sinks[1:]
+}
+
+// Fatal formats and buffers a Fatal-level log entry, flushes the log to
+// disk, and then terminates the process.
+func (this *BufferedLog) Fatal(format string, v ...interface{}) {
+    this.printLevel(LevelFatal, nil, format, v...)
+    this.Close()
+    os.Exit(1)
+}
+
 // FlushInterval returns the interval between log flushes in seconds.
 func (this *BufferedLog) FlushIntervalSec() int32 {
     return atomic.LoadInt32(&this.flushSec)
 }
 
-// Name returns the friendly name of the log. 
+// Format returns the output format configured for this BufferedLog instance.
+func (this *BufferedLog) Format() FLogFormat {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    return this.format
+}
+
+// Info formats and buffers an Info-level log entry.
+func (this *BufferedLog) Info(format string, v ...interface{}) {
+    this.printLevel(LevelInfo, nil, format, v...)
+}
+
+// ModuleVerbosity returns the per-module (per-source-file) verbosity
+// override map configured for this BufferedLog instance.
+func (this *BufferedLog) ModuleVerbosity() map[string]int32 {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    return this.moduleVerbosity
+}
+
+// Name returns the friendly name of the log.
 func (this *BufferedLog) Name() string {
     this.lock.RLock()
     defer this.lock.RUnlock()
@@ -91,21 +175,25 @@ func (this *BufferedLog) Name() string {
     return this.name
 }
 
-// Print formats and buffers a new log entry as long as the BufferedLog instance
-// is enabled.
+// Print formats and buffers a new Info-level log entry as long as the
+// BufferedLog instance is enabled.
 func (this *BufferedLog) Print(format string, v ...interface{}) {
+    this.printLevel(LevelInfo, nil, format, v...)
+}
+
+// Printw formats and buffers a structured Info-level log entry from msg and
+// an alternating list of keys and values.
+func (this *BufferedLog) Printw(msg string, keysAndValues ...interface{}) {
+    this.printLevel(LevelInfo, kvToFields(keysAndValues), msg)
+}
+
+// RotationPolicy returns the automatic rotation policy configured for this
+// BufferedLog instance.
+func (this *BufferedLog) RotationPolicy() RotationPolicy {
     this.lock.RLock()
     defer this.lock.RUnlock()
 
-    if atomic.LoadInt32(&this.enabled) < 1 {
-        return
-    }
-
-    if v == nil {
-        this.print(format)
-    } else {
-        this.print(format, v...)
-    }
+    return this.rotation
 }
 
 // SetFlushIntervalSec sets the interval at which the log buffer worker
@@ -114,7 +202,51 @@ func (this *BufferedLog) SetFlushIntervalSec(interval int32) {
     atomic.StoreInt32(&this.flushSec, interval)
 }
 
-// asyncFlush is run in a separate goroutine and periodically flushes 
+// SetModuleVerbosity replaces the per-module verbosity override map
+// configured for this BufferedLog instance. Used by Restore to undo
+// verbosity changes made since a Snapshot.
+func (this *BufferedLog) SetModuleVerbosity(m map[string]int32) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    this.moduleVerbosity = m
+}
+
+// SetVerbosity sets the default V-level verbosity threshold for this
+// BufferedLog instance.
+func (this *BufferedLog) SetVerbosity(level int32) {
+    atomic.StoreInt32(&this.verbosity, level)
+}
+
+// V returns a Verbose value gating calls at the given V-level against this
+// logger's verbosity threshold, or a per-module override when the calling
+// source file appears in the module verbosity spec.
+func (this *BufferedLog) V(level int32) Verbose {
+    return verboseFor(this, this, level)
+}
+
+// Verbosity returns the default V-level verbosity threshold configured for
+// this BufferedLog instance.
+func (this *BufferedLog) Verbosity() int32 {
+    return atomic.LoadInt32(&this.verbosity)
+}
+
+// Warning formats and buffers a Warning-level log entry.
+func (this *BufferedLog) Warning(format string, v ...interface{}) {
+    this.printLevel(LevelWarning, nil, format, v...)
+}
+
+// WithFields returns an FLog that merges fields into every entry logged
+// through it, while still writing through this BufferedLog's sinks,
+// rotation, and verbosity settings.
+func (this *BufferedLog) WithFields(fields map[string]interface{}) FLog {
+    return &contextLog {
+        fields : copyFields(fields),
+        root   : this,
+    }
+}
+
+// asyncFlush is run in a separate goroutine and periodically flushes
 // buffered entries to the backing file.
 func (this *BufferedLog) asyncFlush() {
     run := true
@@ -125,41 +257,266 @@ func (this *BufferedLog) asyncFlush() {
         select {
             case <-this.chClose:
                 run = false
-                this.print("Async log shutdown")
+                this.print(LevelInfo, nil, "Async log shutdown")
                 continue
             case <-time.After(time.Duration(flushSec) * time.Second):
                 this.flushLogs()
+                this.checkMaxAge()
         }
     }
 
     this.chClose <- nil
 }
 
-// flushLogs copies the contents of the log buffer into the open log file.
+// checkMaxAge rotates the backing log file in place once it has been open
+// longer than the configured RotationPolicy's MaxAge.
+func (this *BufferedLog) checkMaxAge() {
+    if this.rotation.MaxAge <= 0 {
+        return
+    }
+
+    if time.Since(this.rotatedAt) < this.rotation.MaxAge {
+        return
+    }
+
+    this.rotateFile()
+}
+
+// checkMaxBytes rotates the backing log file in place once its size crosses
+// the configured RotationPolicy's MaxBytes threshold.
+func (this *BufferedLog) checkMaxBytes() {
+    if this.rotation.MaxBytes <= 0 {
+        return
+    }
+
+    info, err := this.fileSink.Stat()
+    if err != nil || info.Size() < this.rotation.MaxBytes {
+        return
+    }
+
+    this.rotateFile()
+}
+
+// closeForRotation behaves like Close, except it leaves every sink besides
+// the primary FileSink open, so Rotate can hand them to the replacement
+// FLog instance untouched.
+func (this *BufferedLog) closeForRotation() {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    this.stopAndFlush()
+
+    this.fileSink.Close()
+
+    unregisterLogger(this)
+}
+
+// drainQueue atomically lifts the entire current queue off of this
+// BufferedLog and returns its entries in the chronological order they were
+// enqueued.
+func (this *BufferedLog) drainQueue() []*entryNode {
+    head := atomic.SwapPointer(&this.queueHead, nil)
+
+    var nodes []*entryNode
+
+    for n := (*entryNode)(head); n != nil; n = (*entryNode)(n.next) {
+        nodes = append(nodes, n)
+    }
+
+    // the queue is a stack, so the nodes above were collected most-recent
+    // first; reverse them back into call order before flushing.
+    for i, j := 0, len(nodes) - 1; i < j; i, j = i + 1, j - 1 {
+        nodes[i], nodes[j] = nodes[j], nodes[i]
+    }
+
+    return nodes
+}
+
+// enqueue pushes buf onto this BufferedLog's lock-free entry queue with a
+// CAS loop, contending only with other concurrent Print calls and never
+// blocking on the flusher. The node itself comes from nodePool rather than
+// a fresh allocation; flushLogs returns it once the entry has been written
+// out.
+func (this *BufferedLog) enqueue(buf *bytes.Buffer) {
+    node := nodePool.Get().(*entryNode)
+    node.buf = buf
+
+    for {
+        head := atomic.LoadPointer(&this.queueHead)
+        node.next = head
+
+        if atomic.CompareAndSwapPointer(&this.queueHead, head, unsafe.Pointer(node)) {
+            return
+        }
+    }
+}
+
+// flushLogs drains the entry queue and writes each formatted entry out to
+// every configured sink, returning its buffer and node to their pools once
+// written.
 func (this *BufferedLog) flushLogs() {
-    _, err := io.Copy(this.file, &this.buffer)
+    nodes := this.drainQueue()
+    if len(nodes) == 0 {
+        return
+    }
+
+    for _, n := range nodes {
+        writeToSinks(this.sinks, n.buf.Bytes())
+
+        n.buf.Reset()
+        bufferPool.Put(n.buf)
+
+        n.buf = nil
+        n.next = nil
+        nodePool.Put(n)
+    }
+
+    for _, s := range this.sinks {
+        s.Sync()
+    }
+
+    this.checkMaxBytes()
+}
+
+// isEnabled reports whether this BufferedLog instance is currently enabled.
+// Used by Snapshot to capture state before a test mutates it.
+func (this *BufferedLog) isEnabled() bool {
+    return atomic.LoadInt32(&this.enabled) == 1
+}
+
+// print formats the entry into a buffer pulled from bufferPool and enqueues
+// it for the async flusher, without taking any lock shared with other
+// concurrent Print calls. In JSONFormat mode the entry is rendered as a
+// single JSON object carrying fields; fixFormat is bypassed.
+func (this *BufferedLog) print(level Level, fields map[string]interface{}, format string, v ...interface{}) {
+    buf := bufferPool.Get().(*bytes.Buffer)
+    buf.Reset()
+
+    if this.format == JSONFormat {
+        msg := format
+        if v != nil {
+            msg = fmt.Sprintf(format, v...)
+        }
+
+        writeJSONEntry(buf, this.name, level, fields, msg)
+        log.Print(msg)
+    } else {
+        format = fixFormat(this.name, level, format)
+
+        writeHeader(buf)
+
+        if v == nil {
+            log.Print(format)
+            fmt.Fprint(buf, format)
+        } else {
+            log.Printf(format, v...)
+            fmt.Fprintf(buf, format, v...)
+        }
+    }
+
+    this.enqueue(buf)
+}
+
+// printLevel applies the enabled check and the Error-level stack dump before
+// handing the entry off to print, while the BufferedLog is read-locked.
+func (this *BufferedLog) printLevel(level Level, fields map[string]interface{}, format string, v ...interface{}) {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    if atomic.LoadInt32(&this.enabled) < 1 {
+        return
+    }
+
+    if level == LevelError {
+        format = format + "\n" + captureStack()
+    }
+
+    if v == nil {
+        this.print(level, fields, format)
+    } else {
+        this.print(level, fields, format, v...)
+    }
+}
+
+// rotateFile archives the current backing log file, prunes old backups,
+// and reopens the primary FileSink in its place, all without swapping out
+// the BufferedLog instance itself or touching any extra sinks.
+func (this *BufferedLog) rotateFile() {
+    this.fileSink.Close()
+
+    _, err := archiveLogFile(this.baseDir, this.name, this.rotation.Compress)
     if err != nil {
         panic(err)
     }
 
-    err = this.file.Sync()
+    pruneBackups(this.baseDir, this.name, this.rotation.MaxBackups)
+
+    err = this.fileSink.reopen(path.Join(this.baseDir, this.name + ".log"))
     if err != nil {
         panic(err)
     }
+
+    this.rotatedAt = time.Now()
 }
 
-// print performs log entry formatting and uses a std library logger to
-// write the formatted entry into the BufferedLog's buffer.
-func (this *BufferedLog) print(format string, v ...interface{}) {
-    format = fixFormat(this.name, format)
+// stopAndFlush disables the BufferedLog instance, stops the async flush
+// goroutine, and flushes any remaining buffered entries out to every
+// configured sink. It is shared by Close and closeForRotation, which differ
+// only in which sinks they go on to close afterward.
+func (this *BufferedLog) stopAndFlush() {
+    this.enabled = 0
 
-    if v == nil {
-        log.Print(format)
-        this.logger.Print(format)
-    } else {
-        log.Printf(format, v...)
-        this.logger.Printf(format, v...)
+    this.print(LevelInfo, nil, "==== Close log ====")
+
+    this.chClose <- nil
+    <-this.chClose
+
+    this.flushLogs()
+}
+
+// callerLine walks the stack past flog's own frames and returns the file
+// and line of the first external caller. Unlike a fixed runtime.Caller
+// skip count, this stays correct regardless of which flog method was
+// entered or whether the compiler inlined any of them.
+//
+// It resolves each candidate PC with runtime.FuncForPC rather than
+// runtime.CallersFrames: CallersFrames pays to expand inlined calls into
+// their own logical frames, which this package has no use for since it
+// only cares which physical frame first steps outside pkgPath. Skipping
+// that expansion is both faster and allocation-free.
+func callerLine() (string, int) {
+    var pcs [32]uintptr
+    n := runtime.Callers(3, pcs[:])
+
+    for _, pc := range pcs[:n] {
+        // pc is a return address; back it up one byte to resolve the
+        // calling instruction itself rather than whatever follows it.
+        fn := runtime.FuncForPC(pc - 1)
+        if fn == nil {
+            continue
+        }
+
+        if !strings.HasPrefix(fn.Name(), pkgPath + ".") {
+            file, line := fn.FileLine(pc - 1)
+            return filepath.Base(file), line
+        }
     }
+
+    return "???", 0
 }
 
+// writeHeader writes a date/time/shortfile prefix into buf, mirroring the
+// header a *log.Logger configured with FLogFlags would have produced, but
+// without going through log.Logger's internal output lock.
+func writeHeader(buf *bytes.Buffer) {
+    now := time.Now()
+    file, line := callerLine()
 
+    fmt.Fprintf(
+        buf,
+        "%04d/%02d/%02d %02d:%02d:%02d.%06d %s:%d: ",
+        now.Year(), now.Month(), now.Day(),
+        now.Hour(), now.Minute(), now.Second(), now.Nanosecond() / 1000,
+        file, line,
+    )
+}
@@ -0,0 +1,88 @@
+//  ---------------------------------------------------------------------------
+//
+//  BufferedLog_test.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package flog
+
+import (
+    "bytes"
+    "log"
+    "sync"
+    "testing"
+)
+
+// legacyBufferedLog reproduces the pre-chunk0-3 BufferedLog.print path: a
+// single shared bytes.Buffer guarded by one sync.Mutex, with every Print
+// call tee'd to the standard logger and then formatted straight into the
+// shared buffer. It exists only so BenchmarkBufferedLogPrint has something
+// to compare against; the real implementation it mirrors was replaced by
+// the pooled-buffer, lock-free queue design in BufferedLog.
+type legacyBufferedLog struct {
+    buffer bytes.Buffer
+    lock   sync.Mutex
+    logger *log.Logger
+    name   string
+}
+
+func newLegacyBufferedLog(name string) *legacyBufferedLog {
+    l := &legacyBufferedLog{name: name}
+    l.logger = log.New(&l.buffer, "", FLogFlags)
+
+    return l
+}
+
+func (this *legacyBufferedLog) Print(format string, v ...interface{}) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    format = fixFormat(this.name, LevelInfo, format)
+
+    if v == nil {
+        log.Print(format)
+        this.logger.Print(format)
+    } else {
+        log.Printf(format, v...)
+        this.logger.Printf(format, v...)
+    }
+}
+
+// BenchmarkBufferedLogPrintLegacy measures the shared-buffer-plus-mutex
+// design BufferedLog used before chunk0-3, as a baseline for
+// BenchmarkBufferedLogPrint.
+func BenchmarkBufferedLogPrintLegacy(b *testing.B) {
+    l := newLegacyBufferedLog("bench")
+
+    b.ReportAllocs()
+    b.ResetTimer()
+
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            l.Print("benchmark entry %d", 42)
+        }
+    })
+}
+
+// BenchmarkBufferedLogPrint measures the pooled-buffer, lock-free-queue
+// Print path introduced in chunk0-3, for comparison against
+// BenchmarkBufferedLogPrintLegacy.
+func BenchmarkBufferedLogPrint(b *testing.B) {
+    l := New("bench", b.TempDir(), BufferedFile).(*BufferedLog)
+    defer l.Close()
+
+    b.ReportAllocs()
+    b.ResetTimer()
+
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            l.Print("benchmark entry %d", 42)
+        }
+    })
+}
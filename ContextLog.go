@@ -0,0 +1,106 @@
+//  ---------------------------------------------------------------------------
+//
+//  ContextLog.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package flog
+
+import (
+    "os"
+)
+
+// contextLog decorates an entryLogger with a fixed set of contextual
+// key/value fields, merged into every entry logged through it. It is
+// returned by WithFields and implements FLog by delegating administrative
+// calls to root and routing entries through root's printLevel so that they
+// still go through root's own formatting, sinks, and rotation.
+type contextLog struct {
+    fields map[string]interface{}
+    root   entryLogger
+}
+
+// BaseDir returns the base directory of the file backing the root logger.
+func (this *contextLog) BaseDir() string {
+    return this.root.BaseDir()
+}
+
+// Close closes the root logger.
+func (this *contextLog) Close() {
+    this.root.Close()
+}
+
+// Disable temporarily disables the root logger. New calls to Print will
+// have no effect.
+func (this *contextLog) Disable() {
+    this.root.Disable()
+}
+
+// Enable re-enables the root logger.
+func (this *contextLog) Enable() {
+    this.root.Enable()
+}
+
+// Error formats and logs an Error-level entry, with this contextLog's
+// fields attached.
+func (this *contextLog) Error(format string, v ...interface{}) {
+    this.root.printLevel(LevelError, this.fields, format, v...)
+}
+
+// Fatal formats and logs a Fatal-level entry with this contextLog's fields
+// attached, then terminates the process.
+func (this *contextLog) Fatal(format string, v ...interface{}) {
+    this.root.printLevel(LevelFatal, this.fields, format, v...)
+    this.root.Close()
+    os.Exit(1)
+}
+
+// Info formats and logs an Info-level entry, with this contextLog's fields
+// attached.
+func (this *contextLog) Info(format string, v ...interface{}) {
+    this.root.printLevel(LevelInfo, this.fields, format, v...)
+}
+
+// Name returns the friendly name of the root logger.
+func (this *contextLog) Name() string {
+    return this.root.Name()
+}
+
+// Print formats and logs a new Info-level entry, with this contextLog's
+// fields attached.
+func (this *contextLog) Print(format string, v ...interface{}) {
+    this.root.printLevel(LevelInfo, this.fields, format, v...)
+}
+
+// Printw formats a structured Info-level entry from msg and an alternating
+// list of keys and values, merged with this contextLog's attached fields.
+func (this *contextLog) Printw(msg string, keysAndValues ...interface{}) {
+    this.root.printLevel(LevelInfo, mergeFields(this.fields, kvToFields(keysAndValues)), msg)
+}
+
+// V returns a Verbose value gating calls at the given V-level against the
+// root logger's verbosity threshold.
+func (this *contextLog) V(level int32) Verbose {
+    return verboseFor(this.root, this, level)
+}
+
+// Warning formats and logs a Warning-level entry, with this contextLog's
+// fields attached.
+func (this *contextLog) Warning(format string, v ...interface{}) {
+    this.root.printLevel(LevelWarning, this.fields, format, v...)
+}
+
+// WithFields returns a new contextLog wrapping the same root logger, with
+// fields merged on top of this contextLog's existing fields.
+func (this *contextLog) WithFields(fields map[string]interface{}) FLog {
+    return &contextLog {
+        fields : mergeFields(this.fields, fields),
+        root   : this.root,
+    }
+}
@@ -2,7 +2,7 @@
 //
 //  DirectLog.go
 //
-//  Copyright (c) 2014, Jared Chavez. 
+//  Copyright (c) 2014, Jared Chavez.
 //  All rights reserved.
 //
 //  Use of this source code is governed by a BSD-style
@@ -13,22 +13,31 @@
 package flog
 
 import (
+    "bytes"
+    "fmt"
     "log"
     "os"
+    "path"
     "sync"
     "sync/atomic"
+    "time"
 )
 
 // DirectLog represents a file-backed logger and enforces a standardized
-// logging format. New logging entries are written immediately to the 
+// logging format. New logging entries are written immediately to the
 // backing file.
 type DirectLog struct {
-    baseDir  string
-    enabled  int32
-    file     *os.File
-    lock     sync.RWMutex
-    logger   *log.Logger
-    name     string
+    baseDir         string
+    enabled         int32
+    fileSink        *FileSink
+    format          FLogFormat
+    lock            sync.RWMutex
+    moduleVerbosity map[string]int32
+    name            string
+    rotatedAt       time.Time
+    rotation        RotationPolicy
+    sinks           []Sink
+    verbosity       int32
 }
 
 // BaseDir returns the base directory of the file backing this DirectLog instance.
@@ -39,18 +48,22 @@ func (this *DirectLog) BaseDir() string {
     return this.baseDir
 }
 
-// Close disables the DirectLog instance, flushes any remaining entries to disk, and
-// then closes the backing log file.
+// Close disables the DirectLog instance, flushes any remaining entries to
+// disk, and then closes every configured sink.
 func (this *DirectLog) Close() {
     this.lock.Lock()
     defer this.lock.Unlock()
 
     this.enabled = 0
 
-    this.print("==== Close log ====")
+    this.print(LevelInfo, nil, "==== Close log ====")
 
-    this.file.Sync()
-    this.file.Close()
+    for _, s := range this.sinks {
+        s.Sync()
+        s.Close()
+    }
+
+    unregisterLogger(this)
 }
 
 // Disable temporarily disables the DirectLog instance. New calls to Print will have no
@@ -64,7 +77,57 @@ func (this *DirectLog) Enable() {
     atomic.StoreInt32(&this.enabled, 1)
 }
 
-// Name returns the friendly name of the log. 
+// Error formats and writes an Error-level log entry, with a stack dump of
+// the calling goroutine appended to the formatted line.
+func (this *DirectLog) Error(format string, v ...interface{}) {
+    this.printLevel(LevelError, nil, format, v...)
+}
+
+// ExtraSinks returns the Sinks configured on this DirectLog instance via
+// WithSinks, beyond the primary FileSink. Rotate uses this to carry them
+// over to the replacement FLog instance untouched.
+func (this *DirectLog) ExtraSinks() []Sink {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    if len(this.sinks) <= 1 {
+        return nil
+    }
+
+    return this.sinks[1:]
+}
+
+// Fatal formats and writes a Fatal-level log entry, then terminates the
+// process.
+func (this *DirectLog) Fatal(format string, v ...interface{}) {
+    this.printLevel(LevelFatal, nil, format, v...)
+    this.Close()
+    os.Exit(1)
+}
+
+// Format returns the output format configured for this DirectLog instance.
+func (this *DirectLog) Format() FLogFormat {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    return this.format
+}
+
+// Info formats and writes an Info-level log entry.
+func (this *DirectLog) Info(format string, v ...interface{}) {
+    this.printLevel(LevelInfo, nil, format, v...)
+}
+
+// ModuleVerbosity returns the per-module (per-source-file) verbosity
+// override map configured for this DirectLog instance.
+func (this *DirectLog) ModuleVerbosity() map[string]int32 {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+
+    return this.moduleVerbosity
+}
+
+// Name returns the friendly name of the log.
 func (this *DirectLog) Name() string {
     this.lock.RLock()
     defer this.lock.RUnlock()
@@ -72,35 +135,208 @@ func (this *DirectLog) Name() string {
     return this.name
 }
 
-// Print formats and buffers a new log entry as long as the DirectLog instance
-// is enabled.
+// Print formats and writes a new Info-level log entry as long as the
+// DirectLog instance is enabled.
 func (this *DirectLog) Print(format string, v ...interface{}) {
+    this.printLevel(LevelInfo, nil, format, v...)
+}
+
+// Printw formats and writes a structured Info-level log entry from msg and
+// an alternating list of keys and values.
+func (this *DirectLog) Printw(msg string, keysAndValues ...interface{}) {
+    this.printLevel(LevelInfo, kvToFields(keysAndValues), msg)
+}
+
+// RotationPolicy returns the automatic rotation policy configured for this
+// DirectLog instance.
+func (this *DirectLog) RotationPolicy() RotationPolicy {
     this.lock.RLock()
     defer this.lock.RUnlock()
 
-    if atomic.LoadInt32(&this.enabled) < 1 {
-        return
+    return this.rotation
+}
+
+// SetModuleVerbosity replaces the per-module verbosity override map
+// configured for this DirectLog instance. Used by Restore to undo
+// verbosity changes made since a Snapshot.
+func (this *DirectLog) SetModuleVerbosity(m map[string]int32) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    this.moduleVerbosity = m
+}
+
+// SetVerbosity sets the default V-level verbosity threshold for this
+// DirectLog instance.
+func (this *DirectLog) SetVerbosity(level int32) {
+    atomic.StoreInt32(&this.verbosity, level)
+}
+
+// V returns a Verbose value gating calls at the given V-level against this
+// logger's verbosity threshold, or a per-module override when the calling
+// source file appears in the module verbosity spec.
+func (this *DirectLog) V(level int32) Verbose {
+    return verboseFor(this, this, level)
+}
+
+// Verbosity returns the default V-level verbosity threshold configured for
+// this DirectLog instance.
+func (this *DirectLog) Verbosity() int32 {
+    return atomic.LoadInt32(&this.verbosity)
+}
+
+// Warning formats and writes a Warning-level log entry.
+func (this *DirectLog) Warning(format string, v ...interface{}) {
+    this.printLevel(LevelWarning, nil, format, v...)
+}
+
+// WithFields returns an FLog that merges fields into every entry logged
+// through it, while still writing through this DirectLog's sinks, rotation,
+// and verbosity settings.
+func (this *DirectLog) WithFields(fields map[string]interface{}) FLog {
+    return &contextLog {
+        fields : copyFields(fields),
+        root   : this,
     }
+}
 
-    if v == nil {
-        this.print(format)
+// checkRotation rotates the backing log file in place once either the
+// configured RotationPolicy's MaxBytes or MaxAge threshold has been
+// crossed. DirectLog has no background goroutine, so both checks happen
+// inline after every write. Takes the exclusive write lock itself so that
+// concurrent writers racing past the threshold can't both rotate the same
+// file out from under each other.
+func (this *DirectLog) checkRotation() {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    rotate := false
+
+    if this.rotation.MaxBytes > 0 {
+        if info, err := this.fileSink.Stat(); err == nil && info.Size() >= this.rotation.MaxBytes {
+            rotate = true
+        }
+    }
+
+    if this.rotation.MaxAge > 0 && time.Since(this.rotatedAt) >= this.rotation.MaxAge {
+        rotate = true
+    }
+
+    if rotate {
+        this.rotateFile()
+    }
+}
+
+// closeForRotation behaves like Close, except it leaves every sink besides
+// the primary FileSink open, so Rotate can hand them to the replacement
+// FLog instance untouched.
+func (this *DirectLog) closeForRotation() {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    this.enabled = 0
+
+    this.print(LevelInfo, nil, "==== Close log ====")
+
+    this.fileSink.Sync()
+    this.fileSink.Close()
+
+    unregisterLogger(this)
+}
+
+// isEnabled reports whether this DirectLog instance is currently enabled.
+// Used by Snapshot to capture state before a test mutates it.
+func (this *DirectLog) isEnabled() bool {
+    return atomic.LoadInt32(&this.enabled) == 1
+}
+
+// print formats the entry into a pooled buffer and writes it out to every
+// configured sink immediately. In JSONFormat mode the entry is rendered as
+// a single JSON object carrying fields; fixFormat is bypassed.
+func (this *DirectLog) print(level Level, fields map[string]interface{}, format string, v ...interface{}) {
+    buf := bufferPool.Get().(*bytes.Buffer)
+    buf.Reset()
+
+    if this.format == JSONFormat {
+        msg := format
+        if v != nil {
+            msg = fmt.Sprintf(format, v...)
+        }
+
+        writeJSONEntry(buf, this.name, level, fields, msg)
+        log.Print(msg)
     } else {
-        this.print(format, v)
+        format = fixFormat(this.name, level, format)
+
+        writeHeader(buf)
+
+        if v == nil {
+            log.Print(format)
+            fmt.Fprint(buf, format)
+        } else {
+            log.Printf(format, v...)
+            fmt.Fprintf(buf, format, v...)
+        }
     }
+
+    writeToSinks(this.sinks, buf.Bytes())
+
+    buf.Reset()
+    bufferPool.Put(buf)
 }
 
-// print performs log entry formatting and uses a std library logger to
-// write the formatted entry into the DirectLog's buffer.
-func (this *DirectLog) print(format string, v ...interface{}) {
-    format = fixFormat(this.name, format)
+// printLevel applies the enabled check and the Error-level stack dump before
+// handing the entry off to print, while the DirectLog is read-locked, then
+// checks rotation thresholds once the read lock is released. checkRotation
+// takes the exclusive write lock itself, so it can't run while print still
+// holds the read lock above it. The unlock and rotation check happen in a
+// defer so that a panic out of print (writeToSinks panics on a primary sink
+// write failure) still releases the lock instead of wedging it forever.
+func (this *DirectLog) printLevel(level Level, fields map[string]interface{}, format string, v ...interface{}) {
+    this.lock.RLock()
+
+    rotate := false
+    defer func() {
+        this.lock.RUnlock()
+        if rotate {
+            this.checkRotation()
+        }
+    }()
+
+    if atomic.LoadInt32(&this.enabled) < 1 {
+        return
+    }
+
+    if level == LevelError {
+        format = format + "\n" + captureStack()
+    }
 
     if v == nil {
-        log.Print(format)
-        this.logger.Print(format)
+        this.print(level, fields, format)
     } else {
-        log.Printf(format, v)
-        this.logger.Printf(format, v)
+        this.print(level, fields, format, v...)
     }
+
+    rotate = true
 }
 
+// rotateFile archives the current backing log file, prunes old backups,
+// and reopens the primary FileSink in its place, all without swapping out
+// the DirectLog instance itself or touching any extra sinks.
+func (this *DirectLog) rotateFile() {
+    this.fileSink.Close()
 
+    _, err := archiveLogFile(this.baseDir, this.name, this.rotation.Compress)
+    if err != nil {
+        panic(err)
+    }
+
+    pruneBackups(this.baseDir, this.name, this.rotation.MaxBackups)
+
+    err = this.fileSink.reopen(path.Join(this.baseDir, this.name + ".log"))
+    if err != nil {
+        panic(err)
+    }
+
+    this.rotatedAt = time.Now()
+}
@@ -0,0 +1,162 @@
+//  ---------------------------------------------------------------------------
+//
+//  NetworkSink.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package flog
+
+import (
+    "errors"
+    "net"
+    "sync"
+    "time"
+)
+
+// Initial and maximum reconnect backoff used by NetworkSink.
+const (
+    networkSinkMinBackoff = 1 * time.Second
+    networkSinkMaxBackoff = 30 * time.Second
+)
+
+// errNetworkSinkDisconnected is returned by Write while a background
+// reconnect is in progress, so callers never block waiting for the network.
+var errNetworkSinkDisconnected = errors.New("flog: network sink is disconnected, reconnecting")
+
+// NetworkSink ships log entries to a remote collector over a network
+// connection (typically "tcp" or "udp"). Reconnecting happens on a
+// background goroutine with exponential backoff; Write never blocks on the
+// network, failing fast with errNetworkSinkDisconnected instead.
+type NetworkSink struct {
+    addr       string
+    closed     bool
+    conn       net.Conn
+    connecting bool
+    lock       sync.Mutex
+    network    string
+}
+
+// NewNetworkSink returns a NetworkSink and kicks off an initial connection
+// attempt to addr over network on a background goroutine.
+func NewNetworkSink(network, addr string) *NetworkSink {
+    this := &NetworkSink {
+        addr    : addr,
+        network : network,
+    }
+
+    this.triggerReconnect()
+
+    return this
+}
+
+// Write sends p to the remote collector. If no connection is currently
+// established, Write fails fast with errNetworkSinkDisconnected rather than
+// blocking the caller on a dial; a background goroutine keeps retrying the
+// connection with exponential backoff in the meantime.
+func (this *NetworkSink) Write(p []byte) error {
+    this.lock.Lock()
+    conn := this.conn
+    this.lock.Unlock()
+
+    if conn == nil {
+        this.triggerReconnect()
+        return errNetworkSinkDisconnected
+    }
+
+    _, err := conn.Write(p)
+    if err != nil {
+        this.lock.Lock()
+        if this.conn == conn {
+            this.conn.Close()
+            this.conn = nil
+        }
+        this.lock.Unlock()
+
+        this.triggerReconnect()
+    }
+
+    return err
+}
+
+// Sync is a no-op; NetworkSink writes are not buffered locally.
+func (this *NetworkSink) Sync() error {
+    return nil
+}
+
+// Close stops any in-progress reconnect attempts and closes the active
+// connection, if any.
+func (this *NetworkSink) Close() error {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    this.closed = true
+
+    if this.conn == nil {
+        return nil
+    }
+
+    err := this.conn.Close()
+    this.conn = nil
+
+    return err
+}
+
+// triggerReconnect starts a background reconnect goroutine unless one is
+// already running or the sink has been closed.
+func (this *NetworkSink) triggerReconnect() {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+
+    if this.closed || this.connecting {
+        return
+    }
+
+    this.connecting = true
+
+    go this.reconnect()
+}
+
+// reconnect dials the remote endpoint off the write path, backing off
+// exponentially between failed attempts up to networkSinkMaxBackoff, and
+// installs the resulting connection for Write to pick up once it succeeds.
+func (this *NetworkSink) reconnect() {
+    backoff := networkSinkMinBackoff
+
+    for {
+        conn, err := net.DialTimeout(this.network, this.addr, backoff)
+
+        this.lock.Lock()
+        if this.closed {
+            this.connecting = false
+            this.lock.Unlock()
+
+            if err == nil {
+                conn.Close()
+            }
+
+            return
+        }
+
+        if err == nil {
+            this.conn = conn
+            this.connecting = false
+            this.lock.Unlock()
+
+            return
+        }
+        this.lock.Unlock()
+
+        time.Sleep(backoff)
+
+        backoff *= 2
+        if backoff > networkSinkMaxBackoff {
+            backoff = networkSinkMaxBackoff
+        }
+    }
+}
@@ -0,0 +1,139 @@
+//  ---------------------------------------------------------------------------
+//
+//  Sink.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package flog
+
+import (
+    "io"
+    "os"
+)
+
+// Sink is a generic log output destination. BufferedLog and DirectLog fan
+// each formatted entry out to every configured Sink; a file on disk is just
+// one implementation among several (see FileSink, WriterSink, SyslogSink,
+// NetworkSink).
+type Sink interface {
+    Write(p []byte) error
+    Sync() error
+    Close() error
+}
+
+// FileSink writes log entries to a regular file on disk. It is the default
+// sink every FLog instance is given and the only Sink implementation that
+// Rotate and the automatic RotationPolicy checks operate on.
+type FileSink struct {
+    file *os.File
+}
+
+// NewFileSink opens or creates the file at path for append and wraps it as
+// a Sink.
+func NewFileSink(path string) (*FileSink, error) {
+    f, err := os.OpenFile(path, FLogOpenFlags, 0660)
+    if err != nil {
+        return nil, err
+    }
+
+    return &FileSink{file: f}, nil
+}
+
+// Write writes p to the backing file.
+func (this *FileSink) Write(p []byte) error {
+    _, err := this.file.Write(p)
+    return err
+}
+
+// Sync flushes the backing file's contents to stable storage.
+func (this *FileSink) Sync() error {
+    return this.file.Sync()
+}
+
+// Close closes the backing file.
+func (this *FileSink) Close() error {
+    return this.file.Close()
+}
+
+// Stat returns the backing file's current os.FileInfo, used by size-based
+// rotation checks.
+func (this *FileSink) Stat() (os.FileInfo, error) {
+    return this.file.Stat()
+}
+
+// reopen closes the current backing file, if any, and opens path as the new
+// backing file. It is used by rotation to swap files in place without
+// discarding the FileSink itself.
+func (this *FileSink) reopen(path string) error {
+    if this.file != nil {
+        this.file.Close()
+    }
+
+    f, err := os.OpenFile(path, FLogOpenFlags, 0660)
+    if err != nil {
+        return err
+    }
+
+    this.file = f
+
+    return nil
+}
+
+// writeToSinks writes p to every sink in order. sinks[0] is always the
+// primary FileSink (see New), so a failure there is treated as fatal and
+// panics, matching the pre-existing behavior of a BufferedLog/DirectLog
+// whose file write fails. Failures in any additional sink are best-effort
+// and swallowed, so a down network collector or syslog daemon never takes
+// the rest of the logger down with it.
+func writeToSinks(sinks []Sink, p []byte) {
+    for i, s := range sinks {
+        err := s.Write(p)
+        if err != nil && i == 0 {
+            panic(err)
+        }
+    }
+}
+
+// WriterSink adapts any io.Writer, such as os.Stderr or an in-memory
+// buffer, into a Sink. Sync and Close are no-ops unless the underlying
+// writer implements them.
+type WriterSink struct {
+    w io.Writer
+}
+
+// NewWriterSink wraps w as a Sink.
+func NewWriterSink(w io.Writer) *WriterSink {
+    return &WriterSink{w: w}
+}
+
+// Write writes p to the underlying io.Writer.
+func (this *WriterSink) Write(p []byte) error {
+    _, err := this.w.Write(p)
+    return err
+}
+
+// Sync calls Sync on the underlying writer if it implements one, and is
+// otherwise a no-op.
+func (this *WriterSink) Sync() error {
+    if s, ok := this.w.(interface{ Sync() error }); ok {
+        return s.Sync()
+    }
+
+    return nil
+}
+
+// Close calls Close on the underlying writer if it implements io.Closer,
+// and is otherwise a no-op.
+func (this *WriterSink) Close() error {
+    if c, ok := this.w.(io.Closer); ok {
+        return c.Close()
+    }
+
+    return nil
+}
@@ -0,0 +1,133 @@
+//  ---------------------------------------------------------------------------
+//
+//  State.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package flog
+
+import (
+    "log"
+    "sync"
+)
+
+// registry tracks every currently open FLog instance, so that Snapshot can
+// walk them without the caller having to keep its own list. New adds to it;
+// Close removes from it.
+var (
+    registryLock sync.Mutex
+    registry     = make(map[entryLogger]struct{})
+)
+
+// registerLogger adds log to the package registry. Called by New once a new
+// FLog instance is fully constructed.
+func registerLogger(log entryLogger) {
+    registryLock.Lock()
+    defer registryLock.Unlock()
+
+    registry[log] = struct{}{}
+}
+
+// unregisterLogger removes log from the package registry. Called by Close
+// and closeForRotation once a logger's resources are torn down.
+func unregisterLogger(log entryLogger) {
+    registryLock.Lock()
+    defer registryLock.Unlock()
+
+    delete(registry, log)
+}
+
+// loggerState captures one registered FLog's mutable settings at the time
+// of a Snapshot.
+type loggerState struct {
+    enabled         bool
+    flushSec        int32
+    log             entryLogger
+    moduleVerbosity map[string]int32
+    verbosity       int32
+}
+
+// State is an opaque snapshot of flog's global mutable state, captured by
+// Snapshot and restored by Restore. It lets tests that exercise flog's
+// process-wide state (open loggers, verbosity, the standard library log
+// flags mutated by this package's init) undo their changes afterward
+// without affecting other tests.
+type State struct {
+    loggers  []loggerState
+    logFlags int
+}
+
+// Snapshot captures the enabled flag, flush interval, and verbosity of
+// every currently open FLog instance, along with the standard library log
+// flags this package mutates in init. Pair with Restore to isolate tests
+// that exercise flog's global state.
+func Snapshot() State {
+    registryLock.Lock()
+    loggers := make([]entryLogger, 0, len(registry))
+    for l := range registry {
+        loggers = append(loggers, l)
+    }
+    registryLock.Unlock()
+
+    state := State {
+        loggers  : make([]loggerState, 0, len(loggers)),
+        logFlags : log.Flags(),
+    }
+
+    for _, l := range loggers {
+        ls := loggerState {
+            enabled         : l.isEnabled(),
+            log             : l,
+            moduleVerbosity : l.ModuleVerbosity(),
+            verbosity       : l.Verbosity(),
+        }
+
+        if bLog, ok := l.(*BufferedLog); ok {
+            ls.flushSec = bLog.FlushIntervalSec()
+        }
+
+        state.loggers = append(state.loggers, ls)
+    }
+
+    return state
+}
+
+// Restore re-applies a State captured by Snapshot: each logger still open
+// has its enabled flag, flush interval, and verbosity reset, and the
+// standard library log flags are restored. Loggers opened after the
+// Snapshot was taken, or closed since, are left alone.
+func Restore(state State) {
+    log.SetFlags(state.logFlags)
+
+    registryLock.Lock()
+    stillOpen := make(map[entryLogger]bool, len(registry))
+    for l := range registry {
+        stillOpen[l] = true
+    }
+    registryLock.Unlock()
+
+    for _, ls := range state.loggers {
+        if !stillOpen[ls.log] {
+            continue
+        }
+
+        if ls.enabled {
+            ls.log.Enable()
+        } else {
+            ls.log.Disable()
+        }
+
+        ls.log.SetVerbosity(ls.verbosity)
+        ls.log.SetModuleVerbosity(ls.moduleVerbosity)
+
+        if bLog, ok := ls.log.(*BufferedLog); ok {
+            bLog.SetFlushIntervalSec(ls.flushSec)
+        }
+    }
+}
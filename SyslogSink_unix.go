@@ -0,0 +1,60 @@
+//  ---------------------------------------------------------------------------
+//
+//  SyslogSink_unix.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+//go:build !windows
+
+package flog
+
+import "log/syslog"
+
+// SyslogSink fans log entries out to the local or remote syslog daemon via
+// the standard library's log/syslog package. It is only available on Unix
+// platforms; see SyslogSink_windows.go for the stub used elsewhere.
+type SyslogSink struct {
+    w *syslog.Writer
+}
+
+// NewSyslogSink dials the syslog daemon described by network/addr (an
+// empty network dials the local daemon) and returns a Sink that writes
+// entries at the given priority, tagged with tag.
+func NewSyslogSink(network, addr string, priority syslog.Priority, tag string) (*SyslogSink, error) {
+    var w *syslog.Writer
+    var err error
+
+    if network == "" {
+        w, err = syslog.New(priority, tag)
+    } else {
+        w, err = syslog.Dial(network, addr, priority, tag)
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &SyslogSink{w: w}, nil
+}
+
+// Write sends p to the syslog daemon.
+func (this *SyslogSink) Write(p []byte) error {
+    _, err := this.w.Write(p)
+    return err
+}
+
+// Sync is a no-op; the syslog daemon owns its own durability guarantees.
+func (this *SyslogSink) Sync() error {
+    return nil
+}
+
+// Close closes the connection to the syslog daemon.
+func (this *SyslogSink) Close() error {
+    return this.w.Close()
+}
@@ -0,0 +1,46 @@
+//  ---------------------------------------------------------------------------
+//
+//  SyslogSink_windows.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+//go:build windows
+
+package flog
+
+import (
+    "errors"
+)
+
+// SyslogSink is unavailable on Windows; the standard library's log/syslog
+// package does not build on this platform at all. NewSyslogSink always
+// returns an error here. See SyslogSink_unix.go for the real implementation
+// used on other platforms.
+type SyslogSink struct{}
+
+// NewSyslogSink always fails on Windows. priority mirrors syslog.Priority's
+// underlying int type so callers don't need a platform-specific import.
+func NewSyslogSink(network, addr string, priority int, tag string) (*SyslogSink, error) {
+    return nil, errors.New("flog: SyslogSink is not supported on windows")
+}
+
+// Write always fails on Windows.
+func (this *SyslogSink) Write(p []byte) error {
+    return errors.New("flog: SyslogSink is not supported on windows")
+}
+
+// Sync always fails on Windows.
+func (this *SyslogSink) Sync() error {
+    return errors.New("flog: SyslogSink is not supported on windows")
+}
+
+// Close is a no-op on Windows.
+func (this *SyslogSink) Close() error {
+    return nil
+}
@@ -2,7 +2,7 @@
 //
 //  init.go
 //
-//  Copyright (c) 2014, Jared Chavez. 
+//  Copyright (c) 2014, Jared Chavez.
 //  All rights reserved.
 //
 //  Use of this source code is governed by a BSD-style
@@ -10,15 +10,24 @@
 //
 //  -----------
 
-// Package flog provides facilities for using and managing 
+// Package flog provides facilities for using and managing
 // file-backed logger objects.
 package flog
 
 import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
     "fmt"
+    "io"
+    "io/ioutil"
     "log"
     "os"
     "path"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strconv"
     "strings"
     "time"
 )
@@ -26,6 +35,9 @@ import (
 // Default flush interval, in seconds, for BufferedLog instances.
 const DefaultFlushIntervalSec = 5
 
+// Default V-style verbosity threshold for new FLog instances.
+const DefaultVerbosity = 0
+
 // Logger format flags.
 const FLogFlags = log.Ldate | log.Lmicroseconds | log.Lshortfile
 
@@ -38,6 +50,82 @@ const (
     DirectFile
 )
 
+// rotateTimestampFormat timestamps archived log files down to the
+// microsecond so that multiple rotations on the same day never collide.
+const rotateTimestampFormat = "20060102-150405.000000"
+
+// Level represents the severity of a single log entry.
+type Level int32
+
+// Enumeration of supported severity levels, following the glog/klog model.
+const (
+    LevelInfo Level = iota
+    LevelWarning
+    LevelError
+    LevelFatal
+)
+
+// String returns the human readable name of the level.
+func (this Level) String() string {
+    switch this {
+    case LevelInfo:
+        return "INFO"
+    case LevelWarning:
+        return "WARNING"
+    case LevelError:
+        return "ERROR"
+    case LevelFatal:
+        return "FATAL"
+    }
+
+    return "UNKNOWN"
+}
+
+// FLogFormat selects how a logger renders each entry.
+type FLogFormat int32
+
+// Enumeration of supported output formats.
+const (
+    // TextFormat renders each entry as "[NAME] [LEVEL] msg", the package's
+    // original behavior.
+    TextFormat FLogFormat = iota
+
+    // JSONFormat renders each entry as a single JSON object with ts, level,
+    // logger, caller, msg, and any fields attached via WithFields or
+    // Printw. fixFormat is bypassed in this mode.
+    JSONFormat
+)
+
+// String returns the human readable name of the format.
+func (this FLogFormat) String() string {
+    switch this {
+    case TextFormat:
+        return "TEXT"
+    case JSONFormat:
+        return "JSON"
+    }
+
+    return "UNKNOWN"
+}
+
+// Verbose is returned by FLog.V and gates a Print call behind a verbosity
+// threshold, so that call sites can write log.V(2).Print(...) and have the
+// call become a no-op whenever the logger's verbosity is set below 2.
+type Verbose struct {
+    enabled bool
+    log     FLog
+}
+
+// Print formats and logs the given entry if the Verbose value was enabled
+// by the V-level check that produced it. Otherwise it does nothing.
+func (this Verbose) Print(format string, v ...interface{}) {
+    if !this.enabled {
+        return
+    }
+
+    this.log.Print(format, v...)
+}
+
 // FLog provides a common interface for different file-backed logs. This package
 // includes two primary implementations; BufferedLog and DirectLog.
 type FLog interface {
@@ -45,132 +133,473 @@ type FLog interface {
     Close()
     Disable()
     Enable()
+    Error(format string, v ...interface{})
+    Fatal(format string, v ...interface{})
+    Info(format string, v ...interface{})
     Name() string
     Print(format string, v ...interface{})
+    Printw(msg string, keysAndValues ...interface{})
+    V(level int32) Verbose
+    Warning(format string, v ...interface{})
+    WithFields(fields map[string]interface{}) FLog
+}
+
+// entryLogger is implemented by the concrete FLog types (BufferedLog and
+// DirectLog) and gives contextLog and verboseFor a way to reach a logger's
+// verbosity settings and low-level entry formatter without growing the
+// public FLog interface.
+type entryLogger interface {
+    FLog
+    ModuleVerbosity() map[string]int32
+    SetModuleVerbosity(m map[string]int32)
+    SetVerbosity(level int32)
+    Verbosity() int32
+    isEnabled() bool
+    printLevel(level Level, fields map[string]interface{}, format string, v ...interface{})
+}
+
+// RotationPolicy controls automatic, in-package log rotation. A zero value
+// disables all automatic rotation; Rotate can still be called explicitly.
+type RotationPolicy struct {
+    // Compress gzip-compresses a log file as it is moved into the old/
+    // subdirectory during rotation.
+    Compress bool
+
+    // MaxAge rotates the backing log file once it has been open longer
+    // than this duration. Zero disables age-based rotation.
+    MaxAge time.Duration
+
+    // MaxBackups prunes archived log files in the old/ subdirectory,
+    // keeping only the MaxBackups most recent. Zero disables pruning.
+    MaxBackups int
+
+    // MaxBytes rotates the backing log file once its size crosses this
+    // threshold. Zero disables size-based rotation.
+    MaxBytes int64
+}
+
+// options holds the optional configuration applied to a new FLog instance.
+// It is populated by the Option values passed to New.
+type options struct {
+    format          FLogFormat
+    moduleVerbosity map[string]int32
+    rotation        RotationPolicy
+    sinks           []Sink
+    verbosity       int32
+}
+
+// Option configures optional, non-default behavior for a new FLog instance.
+type Option func(*options)
+
+// WithVerbosity sets the initial V-level verbosity threshold for a new FLog
+// instance. Calls to log.V(level) are no-ops whenever level exceeds this
+// threshold.
+func WithVerbosity(level int32) Option {
+    return func(o *options) {
+        o.verbosity = level
+    }
+}
+
+// WithModuleVerbosity sets per-module verbosity overrides from a spec string
+// of the form "widget=2,db=3", following glog/klog's vmodule: each entry
+// names a source file (without its .go extension), and a V() call made from
+// a matching file uses that entry's threshold in place of the value set by
+// WithVerbosity, regardless of which FLog instance it was called through.
+func WithModuleVerbosity(spec string) Option {
+    return func(o *options) {
+        o.moduleVerbosity = parseModuleSpec(spec)
+    }
+}
+
+// withModuleVerbosityMap is the internal counterpart to WithModuleVerbosity,
+// used by Rotate to carry an already-parsed override map onto the new FLog
+// instance without re-parsing the original spec string.
+func withModuleVerbosityMap(m map[string]int32) Option {
+    return func(o *options) {
+        o.moduleVerbosity = m
+    }
+}
+
+// WithRotationPolicy enables automatic, in-package log rotation. BufferedLog
+// checks MaxBytes after every flush and MaxAge on every asyncFlush tick;
+// DirectLog checks both on every Print. Rotated files are archived into the
+// old/ subdirectory, gzip-compressed when Compress is set, and pruned down
+// to MaxBackups.
+func WithRotationPolicy(policy RotationPolicy) Option {
+    return func(o *options) {
+        o.rotation = policy
+    }
+}
+
+// WithSinks fans a new FLog instance's output out to additional Sinks,
+// alongside the FileSink New always creates for name/logPath. Pass a
+// WriterSink wrapping os.Stderr, a SyslogSink, a NetworkSink, or any custom
+// Sink implementation. Rotate reuses the same extra sinks across rotations
+// rather than recreating them.
+func WithSinks(sinks ...Sink) Option {
+    return func(o *options) {
+        o.sinks = append(o.sinks, sinks...)
+    }
 }
 
-// New returns a new FLog instance of the requested type. The backing log file is 
+// WithFormat sets the output format for a new FLog instance. The default is
+// TextFormat; JSONFormat renders each entry as a single JSON object and
+// bypasses fixFormat.
+func WithFormat(format FLogFormat) Option {
+    return func(o *options) {
+        o.format = format
+    }
+}
+
+// New returns a new FLog instance of the requested type. The backing log file is
 // created or opened for append.
-func New(name, logPath string, logType int) FLog {
+func New(name, logPath string, logType int, opts ...Option) FLog {
     var newLog FLog
 
+    cfg := options{
+        verbosity: DefaultVerbosity,
+    }
+
+    for _, opt := range opts {
+        opt(&cfg)
+    }
+
     mkdir(logPath)
 
-    f, err := os.OpenFile(
-        path.Join(logPath, name + ".log"), 
-        FLogOpenFlags, 
-        0660,
-    )
+    fileSink, err := NewFileSink(path.Join(logPath, name + ".log"))
     if err != nil {
         return nil
     }
 
+    sinks := append([]Sink{fileSink}, cfg.sinks...)
+
     switch logType {
     case BufferedFile:
 
         bLog := BufferedLog {
-            baseDir  : logPath,
-            chClose  : make(chan interface{}, 0),
-            enabled  : 1,
-            flushSec : DefaultFlushIntervalSec,
-            name     : name,
+            baseDir         : logPath,
+            chClose         : make(chan interface{}, 0),
+            enabled         : 1,
+            fileSink        : fileSink,
+            flushSec        : DefaultFlushIntervalSec,
+            format          : cfg.format,
+            moduleVerbosity : cfg.moduleVerbosity,
+            name            : name,
+            rotatedAt       : time.Now(),
+            rotation        : cfg.rotation,
+            sinks           : sinks,
+            verbosity       : cfg.verbosity,
         }
 
-        bLog.file = f
-
-        l := log.New(&bLog.buffer, "", FLogFlags)
-        bLog.logger = l
-
         go bLog.asyncFlush()
 
         newLog = &bLog
         break
-    
+
     case DirectFile:
 
         dLog := DirectLog {
-            baseDir : logPath,
-            enabled : 1,
-            name    : name,
+            baseDir         : logPath,
+            enabled         : 1,
+            fileSink        : fileSink,
+            format          : cfg.format,
+            moduleVerbosity : cfg.moduleVerbosity,
+            name            : name,
+            rotatedAt       : time.Now(),
+            rotation        : cfg.rotation,
+            sinks           : sinks,
+            verbosity       : cfg.verbosity,
         }
 
-        dLog.file = f
-
-        l := log.New(dLog.file, "", FLogFlags)
-        dLog.logger = l
-
         newLog = &dLog
         break
     }
 
+    registerLogger(newLog.(entryLogger))
+
     newLog.Print("==== Log init ====")
 
     return newLog
 }
 
-// Rotate takes a given FLog instance, closes it, timestamps and moves the 
-// backing log file into an old subdirectory, before opening and returning a new
-// FLog instance at the original location.
+// Rotate takes a given FLog instance, closes its backing file, timestamps
+// and moves it into an old subdirectory, then opens and returns a new FLog
+// instance at the original location. Any extra Sinks configured via
+// WithSinks are left open and carried over to the new instance untouched.
 func Rotate(log FLog) FLog {
-    log.Close()
+    var newLog FLog
+    bLog, ok := log.(*BufferedLog)
+
+    if ok {
+        bLog.closeForRotation()
+
+        policy := bLog.RotationPolicy()
+
+        if _, err := archiveLogFile(log.BaseDir(), log.Name(), policy.Compress); err != nil {
+            panic(err)
+        }
+
+        pruneBackups(log.BaseDir(), log.Name(), policy.MaxBackups)
+
+        newLog = New(
+            log.Name(),
+            log.BaseDir(),
+            BufferedFile,
+            WithVerbosity(bLog.Verbosity()),
+            withModuleVerbosityMap(bLog.ModuleVerbosity()),
+            WithRotationPolicy(policy),
+            WithSinks(bLog.ExtraSinks()...),
+            WithFormat(bLog.Format()),
+        )
+        newLog.(*BufferedLog).SetFlushIntervalSec(bLog.FlushIntervalSec())
+    } else {
+        dLog := log.(*DirectLog)
+        dLog.closeForRotation()
+
+        policy := dLog.RotationPolicy()
+
+        if _, err := archiveLogFile(log.BaseDir(), log.Name(), policy.Compress); err != nil {
+            panic(err)
+        }
+
+        pruneBackups(log.BaseDir(), log.Name(), policy.MaxBackups)
+
+        newLog = New(
+            log.Name(),
+            log.BaseDir(),
+            DirectFile,
+            WithVerbosity(dLog.Verbosity()),
+            withModuleVerbosityMap(dLog.ModuleVerbosity()),
+            WithRotationPolicy(policy),
+            WithSinks(dLog.ExtraSinks()...),
+            WithFormat(dLog.Format()),
+        )
+    }
+
+    return newLog
+}
 
-    mkPath := path.Join(log.BaseDir(), "old")
+// archiveLogFile moves the active log file for name in baseDir into the
+// old/ subdirectory, timestamping it so repeated rotations never collide,
+// and gzip-compressing it when compress is true. It returns the final
+// archived path.
+func archiveLogFile(baseDir, name string, compress bool) (string, error) {
+    mkPath := path.Join(baseDir, "old")
 
     mkdir(mkPath)
 
-    now     := time.Now()
+    oldPath := path.Join(baseDir, name + ".log")
     newPath := path.Join(
-        mkPath, 
+        mkPath,
         fmt.Sprintf(
-            "%d%d%d-%s.log", 
-            now.Year(), 
-            now.Month(), 
-            now.Day(), 
-            log.Name(),
+            "%s-%s.log",
+            name,
+            time.Now().Format(rotateTimestampFormat),
         ),
     )
-    oldPath := path.Join(
-        log.BaseDir(), 
-        log.Name() + ".log",
-    )
 
-    err := os.Rename(
-        oldPath, 
-        newPath,
-    )
+    err := os.Rename(oldPath, newPath)
+    if err != nil {
+        return "", err
+    }
 
+    if !compress {
+        return newPath, nil
+    }
+
+    return gzipFile(newPath)
+}
+
+// gzipFile compresses src in place, replacing it with a .gz file of the
+// same contents and removing the uncompressed original.
+func gzipFile(src string) (string, error) {
+    in, err := os.Open(src)
     if err != nil {
-        panic(err)
+        return "", err
     }
+    defer in.Close()
 
-    var newLog FLog
-    bLog, ok := log.(*BufferedLog)
+    dstPath := src + ".gz"
 
-    if ok {
-        newLog = New(log.Name(), log.BaseDir(), BufferedFile)
-        newLog.(*BufferedLog).SetFlushIntervalSec(bLog.FlushIntervalSec())
-    } else {
-        newLog = New(log.Name(), log.BaseDir(), DirectFile)
+    out, err := os.Create(dstPath)
+    if err != nil {
+        return "", err
     }
+    defer out.Close()
 
-    return newLog
+    gz := gzip.NewWriter(out)
+
+    _, err = io.Copy(gz, in)
+    if err != nil {
+        return "", err
+    }
+
+    err = gz.Close()
+    if err != nil {
+        return "", err
+    }
+
+    return dstPath, os.Remove(src)
+}
+
+// pruneBackups removes the oldest archived log files for name in baseDir's
+// old/ subdirectory once there are more than maxBackups of them. A
+// maxBackups of 0 or less disables pruning.
+func pruneBackups(baseDir, name string, maxBackups int) {
+    if maxBackups <= 0 {
+        return
+    }
+
+    oldDir := path.Join(baseDir, "old")
+
+    entries, err := ioutil.ReadDir(oldDir)
+    if err != nil {
+        return
+    }
+
+    prefix  := name + "-"
+    matches := make([]os.FileInfo, 0, len(entries))
+
+    for _, entry := range entries {
+        if strings.HasPrefix(entry.Name(), prefix) {
+            matches = append(matches, entry)
+        }
+    }
+
+    if len(matches) <= maxBackups {
+        return
+    }
+
+    sort.Slice(matches, func(i, j int) bool {
+        return matches[i].ModTime().Before(matches[j].ModTime())
+    })
+
+    for _, entry := range matches[:len(matches) - maxBackups] {
+        os.Remove(path.Join(oldDir, entry.Name()))
+    }
 }
 
-// fixFormat takes a given format string, prepends the log name to the beginning of
-// the string, and makes sure that it is terminated with a newline. The processed
-// string is then returned to the caller.
-func fixFormat(name, format string) string {
+// captureStack returns a formatted stack trace of the calling goroutine. It
+// is appended to Error-level entries so that failures carry their origin.
+func captureStack() string {
+    buf := make([]byte, 4096)
+    n := runtime.Stack(buf, false)
+
+    return string(buf[:n])
+}
+
+// verboseFor builds the Verbose gate for vlog at the given V-level, checking
+// the calling source file against vlog's per-module override map before
+// falling back to vlog's default verbosity threshold, and reporting back
+// through emitter so that decorators such as contextLog can gate their own
+// Print calls rather than the underlying logger's. This mirrors glog/klog's
+// vmodule: the override is keyed by the call site's file, not the logger
+// instance, so one FLog shared across subsystems can gate each differently.
+func verboseFor(vlog entryLogger, emitter FLog, level int32) Verbose {
+    threshold := vlog.Verbosity()
+    if override, ok := vlog.ModuleVerbosity()[callerModule()]; ok {
+        threshold = override
+    }
+
+    return Verbose {
+        enabled : level <= threshold,
+        log     : emitter,
+    }
+}
+
+// callerModule returns the base name, without extension, of the source file
+// that called into a V() gate - e.g. "widget.go" becomes "widget". Used to
+// key per-module verbosity overrides by call site rather than by logger.
+func callerModule() string {
+    file, _ := callerLine()
+
+    return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
+// copyFields returns a shallow copy of fields, so that a contextLog never
+// shares a mutable map with the caller that built it.
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+    cp := make(map[string]interface{}, len(fields))
+    for k, v := range fields {
+        cp[k] = v
+    }
+
+    return cp
+}
+
+// mergeFields returns a new map containing base overlaid with extra, used to
+// combine a contextLog's attached fields with the ad hoc pairs passed to a
+// single Printw call.
+func mergeFields(base, extra map[string]interface{}) map[string]interface{} {
+    merged := copyFields(base)
+    for k, v := range extra {
+        merged[k] = v
+    }
+
+    return merged
+}
+
+// kvToFields converts Printw's alternating key/value arguments into a field
+// map. Keys are stringified with fmt.Sprint; a trailing key with no paired
+// value is recorded under "!BADKEY".
+func kvToFields(keysAndValues []interface{}) map[string]interface{} {
+    fields := make(map[string]interface{}, len(keysAndValues) / 2)
+
+    for i := 0; i < len(keysAndValues); i += 2 {
+        if i + 1 >= len(keysAndValues) {
+            fields["!BADKEY"] = keysAndValues[i]
+            break
+        }
+
+        fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i + 1]
+    }
+
+    return fields
+}
+
+// writeJSONEntry writes a single JSON log entry into buf: the standard
+// ts/level/logger/caller/msg keys, overlaid with fields. Used in JSONFormat
+// mode in place of fixFormat.
+func writeJSONEntry(buf *bytes.Buffer, name string, level Level, fields map[string]interface{}, msg string) {
+    file, line := callerLine()
+
+    entry := make(map[string]interface{}, len(fields) + 5)
+    for k, v := range fields {
+        entry[k] = v
+    }
+
+    entry["ts"]     = time.Now().Format(time.RFC3339Nano)
+    entry["level"]  = level.String()
+    entry["logger"] = name
+    entry["caller"] = fmt.Sprintf("%s:%d", file, line)
+    entry["msg"]    = msg
+
+    data, err := json.Marshal(entry)
+    if err != nil {
+        panic(err)
+    }
+
+    buf.Write(data)
+    buf.WriteByte('\n')
+}
+
+// fixFormat takes a given format string, prepends the log name and level to
+// the beginning of the string, and makes sure that it is terminated with a
+// newline. The processed string is then returned to the caller.
+func fixFormat(name string, level Level, format string) string {
     if format[len(format) - 1] == '\n' {
         return fmt.Sprintf(
-            "[%s] %s",
+            "[%s] [%s] %s",
             strings.ToUpper(name),
+            level,
             format,
         )
     }
 
     return fmt.Sprintf(
-        "[%s] %s\n",
+        "[%s] [%s] %s\n",
         strings.ToUpper(name),
+        level,
         format,
     )
 }
@@ -187,3 +616,30 @@ func mkdir(path string) {
         panic(err)
     }
 }
+
+// parseModuleSpec parses a per-module verbosity override spec of the form
+// "widget=2,db=3" into a map of source file base name (sans .go) to
+// threshold. Malformed entries are skipped.
+func parseModuleSpec(spec string) map[string]int32 {
+    result := make(map[string]int32)
+
+    if spec == "" {
+        return result
+    }
+
+    for _, pair := range strings.Split(spec, ",") {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 {
+            continue
+        }
+
+        level, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 32)
+        if err != nil {
+            continue
+        }
+
+        result[strings.TrimSpace(kv[0])] = int32(level)
+    }
+
+    return result
+}